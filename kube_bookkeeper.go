@@ -1,6 +1,10 @@
 package main // import "github.com/jmccarty3/kube2consul"
 
 import (
+	"flag"
+	"sync"
+	"time"
+
 	"github.com/golang/glog"
 	//"k8s.io/kubernetes/pkg/api"
 	kapi "k8s.io/kubernetes/pkg/api"
@@ -9,6 +13,19 @@ import (
 	klabels "k8s.io/kubernetes/pkg/labels"
 )
 
+//RegistrationModeNodes Registers services by Service type, regardless of which pods back them: NodePort (and unprovisioned LoadBalancer) services against every node's address, ClusterIP and provisioned LoadBalancer services once at their single address
+const RegistrationModeNodes = "nodes"
+
+//RegistrationModePods Registers only the addresses of the ready pods actually backing a service
+const RegistrationModePods = "pods"
+
+var registrationMode = flag.String("registration-mode", RegistrationModeNodes, "How services are registered with Consul. 'nodes' registers by Service type: NodePort services on every node address, ClusterIP/LoadBalancer services once at their own address. 'pods' registers only the ready pods backing the service, at each pod's IP.")
+
+var serviceAnnotationKey = flag.String("service-annotation-key", "consul.register/service-key", "Annotation key that a Service must carry to be registered with Consul")
+var serviceAnnotationValue = flag.String("service-annotation-value", "", "Expected value for -service-annotation-key. If empty, any value for the key is accepted")
+
+var resyncPeriod = flag.Duration("resync-period", 0, "If non-zero, periodically run a full Sync against the API server on this interval in addition to the watch-driven events")
+
 //KubeNode Represents a node in the system
 //TODO: Chang to store Node pointer. Add getName, getReadyStatus accessors
 type KubeNode struct {
@@ -27,14 +44,23 @@ type KubeBookKeeper interface {
 	AddService(*kapi.Service)
 	RemoveService(*kapi.Service)
 	UpdateService(*kapi.Service)
+	AddPod(*kapi.Pod)
+	RemovePod(*kapi.Pod)
+	UpdatePod(*kapi.Pod)
 }
 
 //ClientBookKeeper Bookkeeper that uses a connection the api server
 type ClientBookKeeper struct {
-	client      *kclient.Client
-	nodes       map[string]*KubeNode
-	services    map[string]*kapi.Service
-	consulQueue chan<- ConsulWork
+	sync.RWMutex
+	client              *kclient.Client
+	nodes               map[string]*KubeNode
+	services            map[string]*kapi.Service
+	pods                map[string]*kapi.Pod
+	podServiceIDS       map[string]map[string]string
+	singletonServiceIDS map[string]map[string]string
+	consulQueue         chan<- ConsulWork
+	annotationKey       string
+	annotationValue     string
 }
 
 //BuildServiceBaseID Creates a base id to be used for Consul based on the Node name and the Service name
@@ -42,6 +68,11 @@ func BuildServiceBaseID(nodeName string, service *kapi.Service) string {
 	return nodeName + "-" + service.Name
 }
 
+//BuildPodServiceBaseID Creates a base id to be used for Consul based on the Pod name and the Service name. Used in pod registration mode so Consul reflects only pods actually backing the service.
+func BuildPodServiceBaseID(pod *kapi.Pod, service *kapi.Service) string {
+	return pod.Name + "-" + service.Name
+}
+
 func newKubeNode() *KubeNode {
 	return &KubeNode{
 		name:        "",
@@ -50,79 +81,563 @@ func newKubeNode() *KubeNode {
 	}
 }
 
-//NewClientBookKeeper Creates a new client based Bookkeeper
-func NewClientBookKeeper(client *kclient.Client) *ClientBookKeeper {
+//NewClientBookKeeper Creates a new client based Bookkeeper. annotationKey/annotationValue gate which services get registered: a Service must carry annotationKey, and if annotationValue is non-empty its value must match.
+func NewClientBookKeeper(client *kclient.Client, annotationKey string, annotationValue string) *ClientBookKeeper {
 	return &ClientBookKeeper{
-		client:   client,
-		nodes:    make(map[string]*KubeNode),
-		services: make(map[string]*kapi.Service),
+		client:              client,
+		nodes:               make(map[string]*KubeNode),
+		services:            make(map[string]*kapi.Service),
+		pods:                make(map[string]*kapi.Pod),
+		podServiceIDS:       make(map[string]map[string]string),
+		singletonServiceIDS: make(map[string]map[string]string),
+		annotationKey:       annotationKey,
+		annotationValue:     annotationValue,
 	}
 }
 
+//isTargetService Determines if a Service carries the configured registration annotation
+func (client *ClientBookKeeper) isTargetService(service *kapi.Service) bool {
+	value, ok := service.ObjectMeta.Annotations[client.annotationKey]
+	if !ok {
+		return false
+	}
+	if client.annotationValue == "" {
+		return true
+	}
+	return value == client.annotationValue
+}
+
 //RunBookKeeper Runs the Bookkeeper as long as the work queue is open
 func RunBookKeeper(workQue <-chan KubeWork, consulQueue chan<- ConsulWork, apiClient *kclient.Client) {
 
-	client := NewClientBookKeeper(apiClient)
+	client := NewClientBookKeeper(apiClient, *serviceAnnotationKey, *serviceAnnotationValue)
 	client.consulQueue = consulQueue
 
-	for work := range workQue {
-		switch work.Action {
-		case KubeWorkAddNode:
-			client.AddNode(work.Node)
-		case KubeWorkRemoveNode:
-			client.RemoveNode(work.Node.Name)
-		case KubeWorkAddService:
-			client.AddService(work.Service)
-		case KubeWorkRemoveService:
-			client.RemoveService(work.Service)
-		case KubeWorkUpdateService:
-			client.UpdateService(work.Service)
-		case KubeWorkSync:
+	//resyncTick stays nil (and so blocks forever in the select below) when no resync period is configured
+	var resyncTick <-chan time.Time
+	if *resyncPeriod > 0 {
+		ticker := time.NewTicker(*resyncPeriod)
+		defer ticker.Stop()
+		resyncTick = ticker.C
+	}
+
+	for {
+		select {
+		case work, ok := <-workQue:
+			if !ok {
+				glog.Info("Completed all node work")
+				return
+			}
+
+			switch work.Action {
+			case KubeWorkAddNode:
+				client.AddNode(work.Node)
+			case KubeWorkRemoveNode:
+				client.RemoveNode(work.Node.Name)
+			case KubeWorkAddService:
+				client.AddService(work.Service)
+			case KubeWorkRemoveService:
+				client.RemoveService(work.Service)
+			case KubeWorkUpdateService:
+				client.UpdateService(work.Service)
+			case KubeWorkAddPod:
+				client.AddPod(work.Pod)
+			case KubeWorkRemovePod:
+				client.RemovePod(work.Pod)
+			case KubeWorkUpdatePod:
+				client.UpdatePod(work.Pod)
+			case KubeWorkSync:
+				client.Sync()
+			default:
+				glog.Info("Unsupported work action: ", work.Action)
+			}
+		case <-resyncTick:
+			//Run on the same goroutine as the watch-driven events above so a resync never races a concurrent Add/Remove
 			client.Sync()
-		default:
-			glog.Info("Unsupported work action: ", work.Action)
+		}
+	}
+}
+
+//loadBalancerAddress Returns the address to use for a LoadBalancer service: the requested LoadBalancerIP if set, otherwise the first assigned ingress address. Empty if the load balancer has not been provisioned yet.
+func loadBalancerAddress(service *kapi.Service) string {
+	if service.Spec.LoadBalancerIP != "" {
+		return service.Spec.LoadBalancerIP
+	}
+
+	if len(service.Status.LoadBalancer.Ingress) > 0 {
+		ingress := service.Status.LoadBalancer.Ingress[0]
+		if ingress.IP != "" {
+			return ingress.IP
+		}
+		return ingress.Hostname
+	}
+
+	return ""
+}
+
+//servicePortsEqual Determines if two ServicePorts describe the same exposed endpoint
+func servicePortsEqual(a, b kapi.ServicePort) bool {
+	return a.Name == b.Name && a.Port == b.Port && a.NodePort == b.NodePort && a.Protocol == b.Protocol
+}
+
+//diffServicePorts Splits the difference between an old and new port list into the ports that disappeared and the ports that are new or changed
+func diffServicePorts(oldPorts []kapi.ServicePort, newPorts []kapi.ServicePort) (removed []kapi.ServicePort, added []kapi.ServicePort) {
+	for _, oldPort := range oldPorts {
+		stillPresent := false
+		for _, newPort := range newPorts {
+			if servicePortsEqual(oldPort, newPort) {
+				stillPresent = true
+				break
+			}
+		}
+		if !stillPresent {
+			removed = append(removed, oldPort)
+		}
+	}
+
+	for _, newPort := range newPorts {
+		isNew := true
+		for _, oldPort := range oldPorts {
+			if servicePortsEqual(oldPort, newPort) {
+				isNew = false
+				break
+			}
+		}
+		if isNew {
+			added = append(added, newPort)
 		}
 	}
 
-	glog.Info("Completed all node work")
+	return removed, added
 }
 
+//isNodeBoundService Determines whether a service's entries are tied to individual node addresses (NodePort, or LoadBalancer before it has been provisioned) rather than a single ClusterIP/LoadBalancer address
+func isNodeBoundService(service *kapi.Service) bool {
+	return service.Spec.Type == kapi.ServiceTypeNodePort ||
+		(service.Spec.Type == kapi.ServiceTypeLoadBalancer && loadBalancerAddress(service) == "")
+}
+
+//registerServicePorts Emits a distinct Consul DNS entry for each of the given ports, tagged with the port name, and records the base IDs used under ids so they can be torn down later.
+func (client *ClientBookKeeper) registerServicePorts(baseIDPrefix string, address string, service *kapi.Service, ports []kapi.ServicePort, ids map[string]string) {
+	for _, port := range ports {
+		portNumber := port.Port
+		if isNodeBoundService(service) {
+			//Registering against a node address (NodePort, or an unprovisioned LoadBalancer falling back to node addresses) only routes through the node's allocated NodePort, not the ClusterIP-relative Port
+			portNumber = port.NodePort
+		}
+
+		baseID := baseIDPrefix + "-" + port.Name
+		client.consulQueue <- ConsulWork{
+			Action:  ConsulWorkAddDNS,
+			Service: service,
+			Config: DNSInfo{
+				BaseID:    baseID,
+				IPAddress: address,
+				Port:      portNumber,
+				Tag:       port.Name,
+			},
+		}
+		glog.V(3).Info("Requesting Addition of services with Base ID: ", baseID)
+		ids[service.Name+"-"+port.Name] = baseID
+	}
+}
+
+//attachSingletonService Registers a service's ports against a single address (its ClusterIP or LoadBalancer address) exactly once, regardless of how many nodes are in the cluster. Caller must hold client.Lock(): it writes client.singletonServiceIDS.
+func (client *ClientBookKeeper) attachSingletonService(service *kapi.Service, address string) {
+	if _, ok := client.singletonServiceIDS[service.Name]; ok {
+		return
+	}
+
+	ids := make(map[string]string)
+	client.registerServicePorts(BuildServiceBaseID(address, service), address, service, service.Spec.Ports, ids)
+	client.singletonServiceIDS[service.Name] = ids
+}
+
+//detachSingletonService Removes any ClusterIP/LoadBalancer entries registered for the service. Caller must hold client.Lock(): it writes client.singletonServiceIDS.
+func (client *ClientBookKeeper) detachSingletonService(service *kapi.Service) {
+	for _, baseID := range client.singletonServiceIDS[service.Name] {
+		client.consulQueue <- ConsulWork{
+			Action: ConsulWorkRemoveDNS,
+			Config: DNSInfo{
+				BaseID: baseID,
+			},
+		}
+		glog.V(3).Info("Requesting Removal of services with Base ID: ", baseID)
+	}
+	delete(client.singletonServiceIDS, service.Name)
+}
+
+//attachServiceToNode Registers DNS entries for a service, branching on the Service's type. ClusterIP services register the cluster IP once, independent of any node. NodePort services register the node's address with each port's allocated NodePort. LoadBalancer services prefer the load balancer's address, falling back to the node's address if one hasn't been provisioned yet.
 func (client *ClientBookKeeper) attachServiceToNode(node *KubeNode, service *kapi.Service) {
-	baseID := BuildServiceBaseID(node.name, service)
-	client.consulQueue <- ConsulWork{
-		Action:  ConsulWorkAddDNS,
-		Service: service,
-		Config: DNSInfo{
-			BaseID:    baseID,
-			IPAddress: node.address,
-		},
+	switch service.Spec.Type {
+	case kapi.ServiceTypeNodePort:
+		client.registerServicePorts(BuildServiceBaseID(node.name, service), node.address, service, service.Spec.Ports, node.serviceIDS)
+	case kapi.ServiceTypeLoadBalancer:
+		if address := loadBalancerAddress(service); address != "" {
+			client.attachSingletonService(service, address)
+		} else {
+			client.registerServicePorts(BuildServiceBaseID(node.name, service), node.address, service, service.Spec.Ports, node.serviceIDS)
+		}
+	default: //ClusterIP, ""
+		client.attachSingletonService(service, service.Spec.ClusterIP)
 	}
-	glog.V(3).Info("Requesting Addition of services with Base ID: ", baseID)
-	node.serviceIDS[service.Name] = baseID
 }
 
-func (client *ClientBookKeeper) detachServiceFromNode(node *KubeNode, service *kapi.Service) {
-	if baseID, ok := node.serviceIDS[service.Name]; ok {
-		//To Consol -> TODO
+//attachServicePorts Registers only the given ports (newly added or changed) for a service, routing to the node loop or the singleton address depending on the service's type
+func (client *ClientBookKeeper) attachServicePorts(service *kapi.Service, ports []kapi.ServicePort) {
+	if len(ports) == 0 {
+		return
+	}
+
+	//Writes node.serviceIDS/client.singletonServiceIDS below, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+
+	if isNodeBoundService(service) {
+		for _, node := range client.nodes {
+			client.registerServicePorts(BuildServiceBaseID(node.name, service), node.address, service, ports, node.serviceIDS)
+		}
+		return
+	}
+
+	address := service.Spec.ClusterIP
+	if service.Spec.Type == kapi.ServiceTypeLoadBalancer {
+		address = loadBalancerAddress(service)
+	}
+
+	ids, ok := client.singletonServiceIDS[service.Name]
+	if !ok {
+		ids = make(map[string]string)
+		client.singletonServiceIDS[service.Name] = ids
+	}
+	client.registerServicePorts(BuildServiceBaseID(address, service), address, service, ports, ids)
+}
+
+//detachServicePorts Removes the registrations for the given ports (removed or changed away from), deleting each port's own tracked base ID directly rather than re-deriving state
+func (client *ClientBookKeeper) detachServicePorts(service *kapi.Service, ports []kapi.ServicePort) {
+	if len(ports) == 0 {
+		return
+	}
+
+	//Writes node.serviceIDS/client.singletonServiceIDS below, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+
+	var staleIDS []string
+
+	if isNodeBoundService(service) {
+		for _, node := range client.nodes {
+			for _, port := range ports {
+				key := service.Name + "-" + port.Name
+				if baseID, ok := node.serviceIDS[key]; ok {
+					staleIDS = append(staleIDS, baseID)
+					delete(node.serviceIDS, key)
+				}
+			}
+		}
+	} else if ids, ok := client.singletonServiceIDS[service.Name]; ok {
+		for _, port := range ports {
+			key := service.Name + "-" + port.Name
+			if baseID, ok := ids[key]; ok {
+				staleIDS = append(staleIDS, baseID)
+				delete(ids, key)
+			}
+		}
+	}
+
+	for _, baseID := range staleIDS {
 		client.consulQueue <- ConsulWork{
 			Action: ConsulWorkRemoveDNS,
 			Config: DNSInfo{
 				BaseID: baseID,
 			},
 		}
+		glog.V(3).Info("Requesting Removal of services with Base ID: ", baseID)
+	}
+}
+
+func (client *ClientBookKeeper) detachServiceFromNode(node *KubeNode, service *kapi.Service) {
+	for _, port := range service.Spec.Ports {
+		key := service.Name + "-" + port.Name
+		if baseID, ok := node.serviceIDS[key]; ok {
+			client.consulQueue <- ConsulWork{
+				Action: ConsulWorkRemoveDNS,
+				Config: DNSInfo{
+					BaseID: baseID,
+				},
+			}
+
+			glog.V(3).Info("Requesting Removal of services with Base ID: ", baseID)
+			delete(node.serviceIDS, key)
+		}
+	}
+}
+
+//podTargetPort Resolves a ServicePort's TargetPort to the actual port number on the pod. IntOrString.IntValue() silently returns 0 for a named (string) TargetPort, so a named port is resolved against the pod's own container ports instead of being passed straight to IntValue().
+func podTargetPort(pod *kapi.Pod, port kapi.ServicePort) int {
+	if port.TargetPort.StrVal == "" {
+		return port.TargetPort.IntValue()
+	}
+
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			if containerPort.Name == port.TargetPort.StrVal {
+				return int(containerPort.ContainerPort)
+			}
+		}
+	}
+
+	glog.Errorf("Pod %s has no container port named %q for service port %s", pod.Name, port.TargetPort.StrVal, port.Name)
+	return 0
+}
+
+//attachServicePortsToPod Registers a Consul DNS entry for each of the given ports against the pod's own IP. Uses the port's TargetPort rather than Port/NodePort, since pod-mode registrations connect straight to the pod instead of going through the Service's port translation. Caller must hold client.Lock(): it writes client.podServiceIDS.
+func (client *ClientBookKeeper) attachServicePortsToPod(pod *kapi.Pod, service *kapi.Service, ports []kapi.ServicePort) {
+	ids, ok := client.podServiceIDS[pod.Name]
+	if !ok {
+		ids = make(map[string]string)
+		client.podServiceIDS[pod.Name] = ids
+	}
+
+	for _, port := range ports {
+		baseID := BuildPodServiceBaseID(pod, service) + "-" + port.Name
+		client.consulQueue <- ConsulWork{
+			Action:  ConsulWorkAddDNS,
+			Service: service,
+			Config: DNSInfo{
+				BaseID:    baseID,
+				IPAddress: pod.Status.PodIP,
+				Port:      podTargetPort(pod, port),
+				Tag:       port.Name,
+			},
+		}
+		glog.V(3).Info("Requesting Addition of pod service with Base ID: ", baseID)
+		ids[service.Name+"-"+port.Name] = baseID
+	}
+}
+
+//attachServiceToPod Registers all of a service's ports against the pod's own IP. Caller must hold client.Lock(): it writes client.podServiceIDS.
+func (client *ClientBookKeeper) attachServiceToPod(pod *kapi.Pod, service *kapi.Service) {
+	client.attachServicePortsToPod(pod, service, service.Spec.Ports)
+}
+
+//detachServicePortsFromPod Removes the Consul DNS entries registered for each of the given ports against the pod. Caller must hold client.Lock(): it writes client.podServiceIDS.
+func (client *ClientBookKeeper) detachServicePortsFromPod(pod *kapi.Pod, service *kapi.Service, ports []kapi.ServicePort) {
+	serviceIDS, ok := client.podServiceIDS[pod.Name]
+	if !ok {
+		return
+	}
+
+	for _, port := range ports {
+		key := service.Name + "-" + port.Name
+		if baseID, ok := serviceIDS[key]; ok {
+			client.consulQueue <- ConsulWork{
+				Action: ConsulWorkRemoveDNS,
+				Config: DNSInfo{
+					BaseID: baseID,
+				},
+			}
+
+			glog.V(3).Info("Requesting Removal of pod service with Base ID: ", baseID)
+			delete(serviceIDS, key)
+		}
+	}
+}
+
+//detachServiceFromPod Removes the Consul DNS entries registered for each of the service's ports against the pod. Caller must hold client.Lock(): it writes client.podServiceIDS.
+func (client *ClientBookKeeper) detachServiceFromPod(pod *kapi.Pod, service *kapi.Service) {
+	client.detachServicePortsFromPod(pod, service, service.Spec.Ports)
+}
+
+//serviceSelectsPod Determines if a Service's selector matches the Pod's labels
+func serviceSelectsPod(service *kapi.Service, pod *kapi.Pod) bool {
+	if len(service.Spec.Selector) == 0 {
+		return false
+	}
+
+	for key, value := range service.Spec.Selector {
+		if pod.ObjectMeta.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+//selectorsEqual Determines if two Service selectors are identical
+func selectorsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if b[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (client *ClientBookKeeper) addAllServicesToPod(pod *kapi.Pod) {
+	//attachServiceToPod writes client.podServiceIDS, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+	for _, service := range client.services {
+		if serviceSelectsPod(service, pod) {
+			client.attachServiceToPod(pod, service)
+		}
+	}
+}
 
+func (client *ClientBookKeeper) removeAllServicesFromPod(pod *kapi.Pod) {
+	//detachServiceFromPod writes client.podServiceIDS, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+	for _, service := range client.services {
+		client.detachServiceFromPod(pod, service)
+	}
+}
+
+//attachServiceToReadyPods Registers a service against every ready pod it currently selects
+func (client *ClientBookKeeper) attachServiceToReadyPods(service *kapi.Service) {
+	//attachServiceToPod writes client.podServiceIDS, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+	for _, pod := range client.pods {
+		if podReady(pod) && serviceSelectsPod(service, pod) {
+			client.attachServiceToPod(pod, service)
+		}
+	}
+}
+
+//detachServiceFromAllPods Removes a service's registration from every pod
+func (client *ClientBookKeeper) detachServiceFromAllPods(service *kapi.Service) {
+	//detachServiceFromPod writes client.podServiceIDS, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+	for _, pod := range client.pods {
+		client.detachServiceFromPod(pod, service)
+	}
+}
+
+//attachServicePortsToReadyPods Registers only the given ports (newly added or changed) for a service against every ready pod it currently selects
+func (client *ClientBookKeeper) attachServicePortsToReadyPods(service *kapi.Service, ports []kapi.ServicePort) {
+	if len(ports) == 0 {
+		return
+	}
+
+	//attachServicePortsToPod writes client.podServiceIDS, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+	for _, pod := range client.pods {
+		if podReady(pod) && serviceSelectsPod(service, pod) {
+			client.attachServicePortsToPod(pod, service, ports)
+		}
+	}
+}
+
+//detachServicePortsFromAllPods Removes the registrations for the given ports (removed or changed away from) from every pod
+func (client *ClientBookKeeper) detachServicePortsFromAllPods(service *kapi.Service, ports []kapi.ServicePort) {
+	if len(ports) == 0 {
+		return
+	}
+
+	//detachServicePortsFromPod writes client.podServiceIDS, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+	for _, pod := range client.pods {
+		client.detachServicePortsFromPod(pod, service, ports)
+	}
+}
+
+//collectAndClearServiceBaseIDs Gathers the base IDs currently registered for a service's ports and removes them from the tracking maps, without sending anything to Consul. Used ahead of a re-registration at a new address so the stale IDs can be deleted explicitly once the new ones are in place.
+func (client *ClientBookKeeper) collectAndClearServiceBaseIDs(service *kapi.Service) []string {
+	//Deletes from node.serviceIDS/client.singletonServiceIDS below, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+
+	var ids []string
+
+	if isNodeBoundService(service) {
+		for _, node := range client.nodes {
+			for _, port := range service.Spec.Ports {
+				key := service.Name + "-" + port.Name
+				if baseID, ok := node.serviceIDS[key]; ok {
+					ids = append(ids, baseID)
+					delete(node.serviceIDS, key)
+				}
+			}
+		}
+		return ids
+	}
+
+	serviceIDS, ok := client.singletonServiceIDS[service.Name]
+	if !ok {
+		return ids
+	}
+	for _, port := range service.Spec.Ports {
+		key := service.Name + "-" + port.Name
+		if baseID, ok := serviceIDS[key]; ok {
+			ids = append(ids, baseID)
+			delete(serviceIDS, key)
+		}
+	}
+	if len(serviceIDS) == 0 {
+		delete(client.singletonServiceIDS, service.Name)
+	}
+	return ids
+}
+
+//removeBaseIDS Sends a Consul removal for each of the given base IDs
+func (client *ClientBookKeeper) removeBaseIDS(ids []string) {
+	for _, baseID := range ids {
+		client.consulQueue <- ConsulWork{
+			Action: ConsulWorkRemoveDNS,
+			Config: DNSInfo{
+				BaseID: baseID,
+			},
+		}
 		glog.V(3).Info("Requesting Removal of services with Base ID: ", baseID)
-		delete(node.serviceIDS, service.Name)
+	}
+}
+
+//attachAllEndpoints Registers every port of a service across all nodes (or its singleton address), used when its addressing has changed wholesale
+func (client *ClientBookKeeper) attachAllEndpoints(service *kapi.Service) {
+	//attachServiceToNode writes client.singletonServiceIDS (via attachSingletonService) and node.serviceIDS, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
+	for _, node := range client.nodes {
+		client.attachServiceToNode(node, service)
+	}
+}
+
+//detachAllEndpoints Removes a service's singleton and per-node registrations
+func (client *ClientBookKeeper) detachAllEndpoints(service *kapi.Service) {
+	//detachSingletonService and detachServiceFromNode both write shared maps, so hold the write lock across the whole call instead of RLock
+	client.Lock()
+	defer client.Unlock()
+	client.detachSingletonService(service)
+	for _, node := range client.nodes {
+		client.detachServiceFromNode(node, service)
 	}
 }
 
 func (client *ClientBookKeeper) addAllServicesToNode(node *KubeNode) {
+	//Pod registration mode registers pod IPs only, never node or ClusterIP addresses
+	if *registrationMode == RegistrationModePods {
+		return
+	}
+
+	//attachServiceToNode writes client.singletonServiceIDS (via attachSingletonService) and node.serviceIDS, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
 	for _, service := range client.services {
 		client.attachServiceToNode(node, service)
 	}
 }
 
 func (client *ClientBookKeeper) removeAllServicesFromNode(node *KubeNode) {
+	//detachServiceFromNode writes node.serviceIDS, so this needs the write lock rather than RLock
+	client.Lock()
+	defer client.Unlock()
 	for _, service := range client.services {
 		client.detachServiceFromNode(node, service)
 	}
@@ -130,7 +645,9 @@ func (client *ClientBookKeeper) removeAllServicesFromNode(node *KubeNode) {
 
 //AddNode Adds a new node to the Bookkeeper
 func (client *ClientBookKeeper) AddNode(newNode *kapi.Node) {
+	client.Lock()
 	if _, ok := client.nodes[newNode.Name]; ok {
+		client.Unlock()
 		glog.Error("Attempted to Add existing node ", newNode.Name)
 		return
 	}
@@ -140,39 +657,50 @@ func (client *ClientBookKeeper) AddNode(newNode *kapi.Node) {
 	createdNode.readyStatus = nodeReady(newNode)
 	createdNode.name = newNode.Name
 	createdNode.address = newNode.Status.Addresses[0].Address
+	client.nodes[newNode.Name] = createdNode
+	client.Unlock()
 
 	//Send request for Service Addition for node and all serviceIDS (Create Service ID here)
 	if createdNode.readyStatus {
 		client.addAllServicesToNode(createdNode)
 	}
-	client.nodes[newNode.Name] = createdNode
 	glog.Info("Added Node: ", newNode.Name)
 }
 
 //RemoveNode Removes the node from the Bookkeeper
 func (client *ClientBookKeeper) RemoveNode(oldNodeName string) {
-	if node, ok := client.nodes[oldNodeName]; ok {
+	client.Lock()
+	node, ok := client.nodes[oldNodeName]
+	if ok {
+		delete(client.nodes, oldNodeName)
+	}
+	client.Unlock()
+
+	if ok {
 		//Remove All DNS for node
 		client.removeAllServicesFromNode(node)
-		//Remove Node from Collection
-		delete(client.nodes, oldNodeName)
 	} else {
 		glog.Error("Attmepted to remove missing node: ", oldNodeName)
 	}
-
 }
 
 //UpdateNode Updates the status for the node.
 func (client *ClientBookKeeper) UpdateNode(updatedNode *kapi.Node) {
+	client.Lock()
+	node, ok := client.nodes[updatedNode.Name]
+	client.Unlock()
+
+	if !ok {
+		return
+	}
+
 	//If now ready -> Service Addtion for node
-	//TODO Check it exists
 	if nodeReady(updatedNode) {
-		client.addAllServicesToNode(client.nodes[updatedNode.Name])
+		client.addAllServicesToNode(node)
 	} else {
-		client.removeAllServicesFromNode(client.nodes[updatedNode.Name])
+		client.removeAllServicesFromNode(node)
 	}
 	//Else -> Service Removal for Node
-	//UnLock
 }
 
 //ContainsNodeName determines if a Node exists in the list with the requested name
@@ -185,28 +713,77 @@ func ContainsNodeName(name string, nodes *kapi.NodeList) bool {
 	return false
 }
 
-//Sync Performs a full syncroniztion of Nodes.
+//Sync Performs a full reconciliation of Nodes and Services against the API server, catching drift that the watches might have missed (e.g. events dropped while disconnected).
 func (client *ClientBookKeeper) Sync() {
-	nodes := client.client.Nodes()
-	if nodeList, err := nodes.List(klabels.Everything(), kfields.Everything()); err == nil {
+	if nodeList, err := client.client.Nodes().List(klabels.Everything(), kfields.Everything()); err == nil {
+		client.Lock()
+		var missingNodes []string
 		for name := range client.nodes {
 			if !ContainsNodeName(name, nodeList) {
-				glog.Errorf("Bookkeeper has node: %s that does not exist in api server", name)
-				client.RemoveNode(name)
+				missingNodes = append(missingNodes, name)
 			}
 		}
+		client.Unlock()
+
+		for _, name := range missingNodes {
+			glog.Errorf("Bookkeeper has node: %s that does not exist in api server", name)
+			client.RemoveNode(name)
+		}
+	}
+
+	if serviceList, err := client.client.Services(kapi.NamespaceAll).List(klabels.Everything()); err == nil {
+		apiServiceNames := make(map[string]bool, len(serviceList.Items))
+		for i := range serviceList.Items {
+			apiServiceNames[serviceList.Items[i].Name] = true
+		}
+
+		client.Lock()
+		var missingServices []*kapi.Service
+		var newServices []*kapi.Service
+		for name, service := range client.services {
+			if !apiServiceNames[name] {
+				missingServices = append(missingServices, service)
+			}
+		}
+		for i := range serviceList.Items {
+			service := &serviceList.Items[i]
+			if _, ok := client.services[service.Name]; !ok {
+				newServices = append(newServices, service)
+			}
+		}
+		client.Unlock()
+
+		for _, service := range missingServices {
+			glog.Errorf("Bookkeeper has service: %s that does not exist in api server", service.Name)
+			client.RemoveService(service)
+		}
+		for _, service := range newServices {
+			client.AddService(service)
+		}
+	}
+
+	//Let the Consul side garbage-collect any entries tagged by this instance that no longer correspond to a (node,service) pair we know about
+	client.consulQueue <- ConsulWork{
+		Action: ConsulWorkReconcile,
 	}
-	//Add Remove as needed
-	//UnLock
 }
 
 //AddService Adds a service to the Bookkeeper
 func (client *ClientBookKeeper) AddService(service *kapi.Service) {
+	if !client.isTargetService(service) {
+		glog.V(3).Info("not a target, skipping: ", service.Name)
+		return
+	}
+
 	//TODO Verify it doesn't exist
+	client.Lock()
 	client.services[service.Name] = service
-	//Perform All DNS Adds
-	for _, node := range client.nodes {
-		client.attachServiceToNode(node, service)
+	client.Unlock()
+
+	if *registrationMode == RegistrationModePods {
+		client.attachServiceToReadyPods(service)
+	} else {
+		client.attachAllEndpoints(service)
 	}
 
 	glog.Info("Added Service: ", service.Name)
@@ -214,18 +791,160 @@ func (client *ClientBookKeeper) AddService(service *kapi.Service) {
 
 //RemoveService Removes the service from the Bookkeeper
 func (client *ClientBookKeeper) RemoveService(service *kapi.Service) {
+	if !client.isTargetService(service) {
+		glog.V(3).Info("not a target, skipping: ", service.Name)
+		return
+	}
+
 	//TODO Verify it does exist
-	//Perform All DNS Removes
-	for _, node := range client.nodes {
-		client.detachServiceFromNode(node, service)
+	if *registrationMode == RegistrationModePods {
+		client.detachServiceFromAllPods(service)
+	} else {
+		client.detachAllEndpoints(service)
 	}
 
+	client.Lock()
 	delete(client.services, service.Name)
+	client.Unlock()
+
 	glog.Info("Removed Service: ", service.Name)
 }
 
-//UpdateService Removes a service and Re-Adds the service
+//AddPod Adds a pod to the Bookkeeper
+func (client *ClientBookKeeper) AddPod(newPod *kapi.Pod) {
+	client.Lock()
+	if _, ok := client.pods[newPod.Name]; ok {
+		client.Unlock()
+		glog.Error("Attempted to Add existing pod ", newPod.Name)
+		return
+	}
+	client.pods[newPod.Name] = newPod
+	client.Unlock()
+
+	if *registrationMode == RegistrationModePods && podReady(newPod) {
+		client.addAllServicesToPod(newPod)
+	}
+	glog.Info("Added Pod: ", newPod.Name)
+}
+
+//RemovePod Removes the pod from the Bookkeeper
+func (client *ClientBookKeeper) RemovePod(oldPod *kapi.Pod) {
+	client.Lock()
+	pod, ok := client.pods[oldPod.Name]
+	if ok {
+		delete(client.pods, oldPod.Name)
+	}
+	client.Unlock()
+
+	if !ok {
+		glog.Error("Attempted to remove missing pod: ", oldPod.Name)
+		return
+	}
+
+	//detachServiceFromPod looks up client.podServiceIDS[pod.Name] for each base ID, so the detach pass must run before that entry is cleared
+	client.removeAllServicesFromPod(pod)
+
+	client.Lock()
+	delete(client.podServiceIDS, oldPod.Name)
+	client.Unlock()
+}
+
+//UpdatePod Updates the status for the pod, attaching or detaching its backing services as its readiness changes
+func (client *ClientBookKeeper) UpdatePod(updatedPod *kapi.Pod) {
+	client.Lock()
+	client.pods[updatedPod.Name] = updatedPod
+	client.Unlock()
+
+	if *registrationMode != RegistrationModePods {
+		return
+	}
+
+	if podReady(updatedPod) {
+		client.addAllServicesToPod(updatedPod)
+	} else {
+		client.removeAllServicesFromPod(updatedPod)
+	}
+}
+
+//UpdateService Reconciles an updated Service against the Bookkeeper. A Service moving into the annotation target set is added and one moving out is removed; a Service that stays a target has its registration diffed against the cached copy instead of being torn down and re-added.
 func (client *ClientBookKeeper) UpdateService(service *kapi.Service) {
-	client.RemoveService(service)
-	client.AddService(service)
+	client.Lock()
+	oldService, wasTarget := client.services[service.Name]
+	client.Unlock()
+
+	isTarget := client.isTargetService(service)
+
+	switch {
+	case wasTarget && isTarget:
+		client.diffUpdateService(oldService, service)
+	case wasTarget && !isTarget:
+		client.RemoveService(oldService)
+	case !wasTarget && isTarget:
+		client.AddService(service)
+	default:
+		glog.V(3).Info("not a target, skipping: ", service.Name)
+	}
+}
+
+//diffUpdateService Computes the delta between the cached service and the incoming one and only touches the Consul entries that actually changed, instead of removing and re-adding everything. Modeled on the dual-stack cluster-IP diff pattern: addresses missing from the new state are queued for deletion while unchanged addresses are left alone.
+func (client *ClientBookKeeper) diffUpdateService(oldService *kapi.Service, service *kapi.Service) {
+	client.Lock()
+	client.services[service.Name] = service
+	client.Unlock()
+
+	if *registrationMode == RegistrationModePods {
+		if !selectorsEqual(oldService.Spec.Selector, service.Spec.Selector) {
+			//A selector change alters which pods this service backs, so the attachments have to be re-derived rather than left for an unrelated pod event to fix up
+			client.detachServiceFromAllPods(oldService)
+			client.attachServiceToReadyPods(service)
+			return
+		}
+
+		removedPorts, addedPorts := diffServicePorts(oldService.Spec.Ports, service.Spec.Ports)
+		if len(removedPorts) == 0 && len(addedPorts) == 0 {
+			glog.V(3).Info("No pod registration changes for service: ", service.Name)
+			return
+		}
+
+		client.detachServicePortsFromAllPods(oldService, removedPorts)
+		client.attachServicePortsToReadyPods(service, addedPorts)
+		return
+	}
+
+	addressChanged := oldService.Spec.Type != service.Spec.Type ||
+		oldService.Spec.ClusterIP != service.Spec.ClusterIP ||
+		loadBalancerAddress(oldService) != loadBalancerAddress(service)
+
+	if addressChanged {
+		//The service's type or address changed: capture the stale base IDs, register at the new address so DNS never has a gap, then delete the captured IDs that were not registered again (a type change such as NodePort to an unprovisioned LoadBalancer keeps the same node-based IDs).
+		staleIDS := client.collectAndClearServiceBaseIDs(oldService)
+		client.attachAllEndpoints(service)
+		client.Lock()
+		currentIDS := make(map[string]bool)
+		for _, baseID := range client.singletonServiceIDS[service.Name] {
+			currentIDS[baseID] = true
+		}
+		for _, node := range client.nodes {
+			for _, baseID := range node.serviceIDS {
+				currentIDS[baseID] = true
+			}
+		}
+		client.Unlock()
+		for _, baseID := range staleIDS {
+			if !currentIDS[baseID] {
+				client.removeBaseIDS([]string{baseID})
+			}
+		}
+		return
+	}
+
+	removedPorts, addedPorts := diffServicePorts(oldService.Spec.Ports, service.Spec.Ports)
+	if len(removedPorts) == 0 && len(addedPorts) == 0 {
+		glog.V(3).Info("No registration changes for service: ", service.Name)
+		return
+	}
+
+	//Detach first: a changed port keeps its name and so its base ID, and detaching after the attach would remove the fresh registration
+	client.detachServicePorts(oldService, removedPorts)
+	client.attachServicePorts(service, addedPorts)
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func TestRegisterServicePortsUnprovisionedLoadBalancerUsesNodePort(t *testing.T) {
+	service := &kapi.Service{
+		ObjectMeta: kapi.ObjectMeta{Name: "web"},
+		Spec: kapi.ServiceSpec{
+			Type:  kapi.ServiceTypeLoadBalancer,
+			Ports: []kapi.ServicePort{{Name: "http", Port: 80, NodePort: 30080}},
+		},
+	}
+
+	consulQueue := make(chan ConsulWork, 1)
+	client := NewClientBookKeeper(nil, "consul.register/service-key", "")
+	client.consulQueue = consulQueue
+
+	client.registerServicePorts(BuildServiceBaseID("node1", service), "10.0.0.1", service, service.Spec.Ports, make(map[string]string))
+
+	work := <-consulQueue
+	if work.Config.Port != service.Spec.Ports[0].NodePort {
+		t.Errorf("registerServicePorts() against a node address used port %d, want NodePort %d", work.Config.Port, service.Spec.Ports[0].NodePort)
+	}
+}
+
+func TestServicePortsEqual(t *testing.T) {
+	base := kapi.ServicePort{Name: "http", Port: 80, NodePort: 30080, Protocol: kapi.ProtocolTCP}
+
+	cases := []struct {
+		name string
+		port kapi.ServicePort
+		want bool
+	}{
+		{"identical", base, true},
+		{"different name", kapi.ServicePort{Name: "https", Port: 80, NodePort: 30080, Protocol: kapi.ProtocolTCP}, false},
+		{"different port", kapi.ServicePort{Name: "http", Port: 81, NodePort: 30080, Protocol: kapi.ProtocolTCP}, false},
+		{"different node port", kapi.ServicePort{Name: "http", Port: 80, NodePort: 30081, Protocol: kapi.ProtocolTCP}, false},
+		{"different protocol", kapi.ServicePort{Name: "http", Port: 80, NodePort: 30080, Protocol: kapi.ProtocolUDP}, false},
+	}
+
+	for _, c := range cases {
+		if got := servicePortsEqual(base, c.port); got != c.want {
+			t.Errorf("%s: servicePortsEqual() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDiffServicePorts(t *testing.T) {
+	http := kapi.ServicePort{Name: "http", Port: 80}
+	httpChanged := kapi.ServicePort{Name: "http", Port: 8080}
+	https := kapi.ServicePort{Name: "https", Port: 443}
+
+	removed, added := diffServicePorts([]kapi.ServicePort{http, https}, []kapi.ServicePort{httpChanged})
+
+	if len(removed) != 2 || len(added) != 1 {
+		t.Fatalf("diffServicePorts() = removed %v, added %v", removed, added)
+	}
+	if added[0] != httpChanged {
+		t.Errorf("expected added port %v, got %v", httpChanged, added[0])
+	}
+}
+
+func TestDiffServicePortsNoChange(t *testing.T) {
+	ports := []kapi.ServicePort{{Name: "http", Port: 80}}
+
+	removed, added := diffServicePorts(ports, ports)
+
+	if len(removed) != 0 || len(added) != 0 {
+		t.Errorf("diffServicePorts() on unchanged ports = removed %v, added %v, want none", removed, added)
+	}
+}
+
+func TestIsNodeBoundService(t *testing.T) {
+	cases := []struct {
+		name    string
+		service *kapi.Service
+		want    bool
+	}{
+		{"cluster ip", &kapi.Service{Spec: kapi.ServiceSpec{Type: kapi.ServiceTypeClusterIP}}, false},
+		{"node port", &kapi.Service{Spec: kapi.ServiceSpec{Type: kapi.ServiceTypeNodePort}}, true},
+		{
+			"load balancer unprovisioned",
+			&kapi.Service{Spec: kapi.ServiceSpec{Type: kapi.ServiceTypeLoadBalancer}},
+			true,
+		},
+		{
+			"load balancer provisioned",
+			&kapi.Service{
+				Spec: kapi.ServiceSpec{Type: kapi.ServiceTypeLoadBalancer},
+				Status: kapi.ServiceStatus{
+					LoadBalancer: kapi.LoadBalancerStatus{
+						Ingress: []kapi.LoadBalancerIngress{{IP: "1.2.3.4"}},
+					},
+				},
+			},
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		if got := isNodeBoundService(c.service); got != c.want {
+			t.Errorf("%s: isNodeBoundService() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLoadBalancerAddress(t *testing.T) {
+	cases := []struct {
+		name    string
+		service *kapi.Service
+		want    string
+	}{
+		{"requested IP wins", &kapi.Service{Spec: kapi.ServiceSpec{LoadBalancerIP: "1.2.3.4"}}, "1.2.3.4"},
+		{
+			"falls back to ingress IP",
+			&kapi.Service{Status: kapi.ServiceStatus{
+				LoadBalancer: kapi.LoadBalancerStatus{Ingress: []kapi.LoadBalancerIngress{{IP: "5.6.7.8"}}},
+			}},
+			"5.6.7.8",
+		},
+		{
+			"falls back to ingress hostname",
+			&kapi.Service{Status: kapi.ServiceStatus{
+				LoadBalancer: kapi.LoadBalancerStatus{Ingress: []kapi.LoadBalancerIngress{{Hostname: "lb.example.com"}}},
+			}},
+			"lb.example.com",
+		},
+		{"unprovisioned", &kapi.Service{}, ""},
+	}
+
+	for _, c := range cases {
+		if got := loadBalancerAddress(c.service); got != c.want {
+			t.Errorf("%s: loadBalancerAddress() = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSelectorsEqual(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b map[string]string
+		want bool
+	}{
+		{"both empty", nil, map[string]string{}, true},
+		{"identical", map[string]string{"app": "foo"}, map[string]string{"app": "foo"}, true},
+		{"different value", map[string]string{"app": "foo"}, map[string]string{"app": "bar"}, false},
+		{"different key", map[string]string{"app": "foo"}, map[string]string{"svc": "foo"}, false},
+		{"different size", map[string]string{"app": "foo"}, map[string]string{"app": "foo", "tier": "web"}, false},
+	}
+
+	for _, c := range cases {
+		if got := selectorsEqual(c.a, c.b); got != c.want {
+			t.Errorf("%s: selectorsEqual() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
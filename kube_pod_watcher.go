@@ -0,0 +1,40 @@
+package main // import "github.com/jmccarty3/kube2consul"
+
+import (
+	"github.com/golang/glog"
+	kapi "k8s.io/kubernetes/pkg/api"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	kfields "k8s.io/kubernetes/pkg/fields"
+	klabels "k8s.io/kubernetes/pkg/labels"
+	kwatch "k8s.io/kubernetes/pkg/watch"
+)
+
+//WatchPods Watches the API server for Pod add/update/delete events and feeds them onto workQueue as KubeWork items. This is the producer-side counterpart to ClientBookKeeper's AddPod/RemovePod/UpdatePod and only needs to run when -registration-mode=pods.
+func WatchPods(client *kclient.Client, workQueue chan<- KubeWork) {
+	watcher, err := client.Pods(kapi.NamespaceAll).Watch(klabels.Everything(), kfields.Everything(), "")
+	if err != nil {
+		glog.Error("Unable to start pod watch: ", err)
+		return
+	}
+
+	for event := range watcher.ResultChan() {
+		pod, ok := event.Object.(*kapi.Pod)
+		if !ok {
+			glog.Error("Received non-Pod object from pod watch")
+			continue
+		}
+
+		switch event.Type {
+		case kwatch.Added:
+			workQueue <- KubeWork{Action: KubeWorkAddPod, Pod: pod}
+		case kwatch.Modified:
+			workQueue <- KubeWork{Action: KubeWorkUpdatePod, Pod: pod}
+		case kwatch.Deleted:
+			workQueue <- KubeWork{Action: KubeWorkRemovePod, Pod: pod}
+		default:
+			glog.V(3).Info("Unhandled pod watch event type: ", event.Type)
+		}
+	}
+
+	glog.Info("Pod watch channel closed")
+}